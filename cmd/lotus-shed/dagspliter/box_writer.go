@@ -0,0 +1,122 @@
+package dagspliter
+
+import (
+	"context"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipld/go-car"
+	carv2 "github.com/ipld/go-car/v2"
+	"golang.org/x/xerrors"
+)
+
+// BoxWriter streams the blocks of a single Box straight to a CARv2 file on
+// disk as the traversal visits them, instead of buffering the whole Box in a
+// bytes.Buffer first. This is what lets us pack DAGs much larger than RAM:
+// the writer only ever holds the block currently being visited in memory.
+//
+// Blocks are first streamed out as a CARv1 payload into a temp file that
+// acts as our deferred store (created lazily on the first write, which is
+// the CARv1 header, so every box creates one), then wrapped into the final
+// CARv2 file -- header,
+// data section, and a `car-index-sorted` index -- once the traversal for
+// this box is done. That gives consumers random-access reads over the
+// result without us needing a second pass over the DAG.
+type BoxWriter struct {
+	outPath string
+
+	dagService ipld.DAGService
+	box        *Box
+
+	tmp *lazyFile // backs the CARv1 payload; not created until first write
+}
+
+// NewBoxWriter prepares a streaming writer for the given box. Nothing is
+// written to disk until Write is called.
+func NewBoxWriter(dagService ipld.DAGService, box *Box, outPath string) *BoxWriter {
+	return &BoxWriter{
+		outPath:    outPath,
+		dagService: dagService,
+		box:        box,
+		tmp:        &lazyFile{path: outPath + ".v1.tmp"},
+	}
+}
+
+// tmpPath is where we stream the intermediate CARv1 payload before wrapping
+// it into the final indexed CARv2 file.
+func (bw *BoxWriter) tmpPath() string {
+	return bw.tmp.path
+}
+
+// Write streams every block reachable from the box's roots, excluding any
+// External sub-DAGs, out of the DAG service and into the box's output file.
+// bw.tmp only actually creates a file the first time car.WriteCarWithWalker
+// writes to it; that first write is the CARv1 header, which it always
+// writes, even for a box with no roots.
+func (bw *BoxWriter) Write(ctx context.Context) error {
+	if err := car.WriteCarWithWalker(ctx, bw.dagService, bw.box.Roots, bw.tmp, BoxCarWalkFunc(bw.box)); err != nil {
+		return xerrors.Errorf("streaming box to temp car: %w", err)
+	}
+
+	return bw.finalize()
+}
+
+// finalize closes the CARv1 temp file, wraps it into the final CARv2 file
+// (data section + `car-index-sorted` index) and removes the temp file.
+func (bw *BoxWriter) finalize() error {
+	if !bw.tmp.opened() {
+		// Nothing was ever written to the temp file; nothing to finalize.
+		return nil
+	}
+
+	if err := bw.tmp.Close(); err != nil {
+		return xerrors.Errorf("closing temp car file: %w", err)
+	}
+
+	if err := carv2.WrapV1File(bw.tmpPath(), bw.outPath); err != nil {
+		return xerrors.Errorf("wrapping box into indexed carv2: %w", err)
+	}
+
+	if err := os.Remove(bw.tmpPath()); err != nil {
+		return xerrors.Errorf("removing temp car file: %w", err)
+	}
+
+	return nil
+}
+
+// Roots are the box's DAG roots, exposed here so callers writing the output
+// filename don't need to reach into the Box themselves.
+func (bw *BoxWriter) Roots() []cid.Cid {
+	return bw.box.Roots
+}
+
+// lazyFile is an io.Writer over a file at path that isn't created until the
+// first call to Write, so a writer that never produces a byte never creates
+// a file on disk.
+type lazyFile struct {
+	path string
+	f    *os.File
+}
+
+func (l *lazyFile) Write(p []byte) (int, error) {
+	if l.f == nil {
+		f, err := os.Create(l.path)
+		if err != nil {
+			return 0, xerrors.Errorf("creating temp car file: %w", err)
+		}
+		l.f = f
+	}
+	return l.f.Write(p)
+}
+
+func (l *lazyFile) opened() bool {
+	return l.f != nil
+}
+
+func (l *lazyFile) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
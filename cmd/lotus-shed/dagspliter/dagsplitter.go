@@ -5,8 +5,8 @@ package dagspliter
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
@@ -22,7 +22,6 @@ import (
 	mdag "github.com/ipfs/go-merkledag"
 	"github.com/ipfs/go-unixfs"
 	uio "github.com/ipfs/go-unixfs/io"
-	"github.com/ipld/go-car"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
 )
@@ -65,12 +64,24 @@ type builder struct {
 	// Minimum size of graph chunks to bother packing into boxes
 	minSubgraphSize uint64
 
+	// Pick the next root to pack FIFO instead of LIFO, so shallow siblings
+	// land in the same box (better for directory listings) instead of
+	// depth-first chains ending up boxed together.
+	breadthFirst bool
+
+	// How to interpret and pack the DAG's layout; see Layout.
+	layout Layout
+
 	// Generated boxes when packing a DAG.
 	boxes []*Box
 	// Used size of the current box we are packing (last one in the list). Since
 	// we only pack one box at a time and don't come back to a box once we're
 	// done with it we just track a single value here and not in each box.
 	boxUsedSize uint64
+	// Final used size of each box once we moved on from it, in the same
+	// order as boxes. Doesn't include the still-open last box; use used()
+	// for that one.
+	boxSizes []uint64
 }
 
 func getSingleNodeSize(node ipld.Node) uint64 {
@@ -99,22 +110,24 @@ func (b *builder) getTreeSize(nd ipld.Node) (uint64, error) {
 		case unixfs.TFile, unixfs.TRaw, unixfs.TDirectory, unixfs.THAMTShard:
 			return n.Size()
 		case unixfs.TMetadata:
-			/*if len(n.Links()) == 0 {
-				return nil, xerrors.New("incorrectly formatted metadata object")
+			// A metadata node wraps a single child with some extra
+			// attributes stored in its own Data; its tree size is its own
+			// node size plus that of the child it wraps.
+			if len(n.Links()) != 1 {
+				return 0, xerrors.New("incorrectly formatted metadata object")
 			}
-			child, err := n.Links()[0].GetNode(ctx, b.dagService)
+			child, err := n.Links()[0].GetNode(context.TODO(), b.dagService)
 			if err != nil {
-				return nil, err
+				return 0, xerrors.Errorf("getting metadata child: %w", err)
 			}
-
-			childpb, ok := child.(*mdag.ProtoNode)
-			if !ok {
-				return nil, mdag.ErrNotProtobuf
-			}*/
-
-			return 0, xerrors.Errorf("metadata object support todo")
+			childSize, err := b.getTreeSize(child)
+			if err != nil {
+				return 0, xerrors.Errorf("getting metadata child tree size: %w", err)
+			}
+			return getSingleNodeSize(n) + childSize, nil
 		case unixfs.TSymlink:
-			return 0, xerrors.Errorf("symlink object support todo")
+			// A symlink node has no children, just its target path in Data.
+			return n.Size()
 		default:
 			return 0, unixfs.ErrUnrecognizedType
 		}
@@ -136,10 +149,19 @@ func (b *builder) box() *Box {
 }
 
 func (b *builder) newBox() {
+	if len(b.boxes) > 0 {
+		b.boxSizes = append(b.boxSizes, b.boxUsedSize)
+	}
 	b.boxes = append(b.boxes, new(Box))
 	b.boxUsedSize = 0
 }
 
+// sizes returns the final used size of every box, including the still-open
+// last one. Meant to be called once packing is done.
+func (b *builder) sizes() []uint64 {
+	return append(append([]uint64{}, b.boxSizes...), b.boxUsedSize)
+}
+
 // Remaining size in the current box.
 // FIXME: Since we allow to pack nodes bigger than box size this might
 //  return a negative value if we over-packed. This is not nice as we
@@ -184,16 +206,24 @@ func (b *builder) addExternalLink(node cid.Cid) {
 
 // Pack a DAG delimited by `initialRoot` in boxes. To enforce the maximum
 // box size the DAG will be decomposed into smaller sub-DAGs if necessary.
+//
+// By default roots are picked LIFO(-ish, node links pushed in reverse),
+// which should result in slightly better data layout (less fragmentation in
+// leaves) than FIFO. Setting b.breadthFirst swaps that for a FIFO frontier
+// instead, so shallow siblings end up packed into the same box.
 func (b *builder) add(ctx context.Context, initialRoot cid.Cid) error {
-	// LIFO queue with the roots that need to be scanned and boxed.
-	// LIFO(-ish, node links pushed in reverse) should result in slightly better
-	// data layout (less fragmentation in leaves) than FIFO.
 	rootsToPack := []cid.Cid{initialRoot}
 
 	for len(rootsToPack) > 0 {
 		// Pick one root node from the queue.
-		root := rootsToPack[len(rootsToPack)-1]
-		rootsToPack = rootsToPack[:len(rootsToPack)-1]
+		var root cid.Cid
+		if b.breadthFirst {
+			root = rootsToPack[0]
+			rootsToPack = rootsToPack[1:]
+		} else {
+			root = rootsToPack[len(rootsToPack)-1]
+			rootsToPack = rootsToPack[:len(rootsToPack)-1]
+		}
 
 		prevNumberOfRoots := len(rootsToPack)
 		err := mdag.Walk(ctx,
@@ -238,6 +268,61 @@ func (b *builder) add(ctx context.Context, initialRoot cid.Cid) error {
 				// and sub-graphs (from the child nodes) and inspect their
 				// sizes separately.
 
+				// A HAMT-sharded directory is a special case: its raw links
+				// are shard buckets keyed by hash prefix, not the real
+				// directory entries, so walking them generically would
+				// split on shard-internal boundaries instead of on whole
+				// entries. Enumerate it with HAMT semantics instead and
+				// pack each entry's sub-DAG as its own unit.
+				if isHAMTShard(node) {
+					newRoots, deferred, err := b.packHAMTShard(ctx, nodeCid, node)
+					if err != nil {
+						panic(fmt.Sprintf("packing hamt shard %s: %s", nodeCid, err))
+					}
+					// Only record this node as a Root if we actually committed
+					// it to the current box; if it was deferred it'll come back
+					// around as its own root once a new box is created.
+					if !deferred && nodeCid == root {
+						b.packRoot(nodeCid)
+					}
+					rootsToPack = append(rootsToPack, newRoots...)
+					return false
+				}
+
+				// In trickle layout, prefer keeping a whole layer (the node
+				// plus its direct leaves) together in one box over letting
+				// the generic per-node splitting below cut across it; only
+				// the continuation into the next, deeper layer is deferred
+				// to a future box.
+				isTrickle := false
+				if b.layout == LayoutTrickle {
+					var err error
+					isTrickle, err = isTrickleLayout(ctx, b.dagService, node)
+					if err != nil {
+						panic(fmt.Sprintf("checking trickle layout %s: %s", nodeCid, err))
+					}
+				}
+				if isTrickle {
+					continuation, layerSize, err := b.packTrickleLayer(ctx, node, treeSize)
+					if err != nil {
+						panic(fmt.Sprintf("packing trickle layer %s: %s", nodeCid, err))
+					}
+					if b.fits(layerSize) {
+						b.addSize(layerSize)
+						if nodeCid == root {
+							b.packRoot(nodeCid)
+						}
+						if continuation != cid.Undef {
+							b.addExternalLink(continuation)
+							rootsToPack = append(rootsToPack, continuation)
+						}
+						b.print("packed whole trickle layer into box")
+						return false
+					}
+					// Even a single layer doesn't fit; fall through to the
+					// generic splitting logic below.
+				}
+
 				// First check if we should even bother splitting the graph more
 				if treeSize > b.minSubgraphSize {
 					// First check the size of the parent node alone.
@@ -326,6 +411,23 @@ var Cmd = &cli.Command{
 			Name:  "breadth-first",
 			Usage: "pack in breadth-first order instead of the default depth-first",
 		},
+		&cli.StringFlag{
+			Name:  "selector",
+			Usage: "dag-json encoded IPLD selector constraining which sub-DAGs to pack; when set, the DAG is packed into a single box matching exactly what that selector would select",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only print a JSON plan of the boxes that would be generated and their approximate sizes, without fetching the whole DAG or writing any CAR files",
+		},
+		&cli.StringFlag{
+			Name:  "layout",
+			Usage: "DAG layout to assume when packing: \"balanced\" (default) or \"trickle\", which keeps whole trickle-DAG layers together in a box",
+			Value: "balanced",
+		},
+		&cli.BoolFlag{
+			Name:  "manifest",
+			Usage: "also write a content-addressed manifest.json/manifest.cbor describing every box generated",
+		},
 	},
 	Action: func(cctx *cli.Context) error {
 		ctx := cctx.Context
@@ -344,8 +446,9 @@ var Cmd = &cli.Command{
 			return xerrors.Errorf("parsing chunk size: %w", err)
 		}
 
-		if cctx.Bool("breadth-first") {
-			return xerrors.Errorf("breadth-first pack not implemented yet")
+		layout, err := ParseLayout(cctx.String("layout"))
+		if err != nil {
+			return xerrors.Errorf("parsing layout: %w", err)
 		}
 
 		// FIXME: The DAG-to-Box generation and Box-to-CAR generation is now
@@ -359,17 +462,39 @@ var Cmd = &cli.Command{
 		}
 		cbs := &countBs{Blockstore: bs}
 
+		if cctx.Bool("dry-run") {
+			plans, err := EstimateBoxes(ctx, mdag.NewDAGService(blockservice.New(cbs, nil)), root, uint64(chunk))
+			if err != nil {
+				return xerrors.Errorf("estimating boxes: %w", err)
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(plans)
+		}
+
 		bb := builder{
 			dagService:      mdag.NewDAGService(blockservice.New(cbs, nil)),
 			boxMaxSize:      uint64(chunk),
 			minSubgraphSize: uint64(cctx.Int("minSubgraphSize")),
+			breadthFirst:    cctx.Bool("breadth-first"),
+			layout:          layout,
 			boxes:           make([]*Box, 0),
 		}
 		bb.newBox() // FIXME: Encapsulate in a constructor.
 
-		err = bb.add(ctx, root)
-		if err != nil {
-			return xerrors.Errorf("error generating boxes: %w", err)
+		if selRaw := cctx.String("selector"); selRaw != "" {
+			sel, err := ParseSelector(selRaw)
+			if err != nil {
+				return xerrors.Errorf("parsing selector: %w", err)
+			}
+			if err := bb.addWithSelector(ctx, root, sel); err != nil {
+				return xerrors.Errorf("error packing selector: %w", err)
+			}
+		} else {
+			if err := bb.add(ctx, root); err != nil {
+				return xerrors.Errorf("error generating boxes: %w", err)
+			}
 		}
 
 		fmt.Fprintf(os.Stderr, "\nBlockstore access stats: get:%d has:%d\n", cbs.get, cbs.has)
@@ -390,21 +515,34 @@ var Cmd = &cli.Command{
 			return xerrors.Errorf("querying directory stat: %w", err)
 		}
 
-		// Write one CAR file for each Box.
+		// Write one CARv2 file (with index) for each Box, streamed directly
+		// to disk so we never hold a whole box in memory.
 		fmt.Fprintf(os.Stderr, "\nWriting CAR files to directory %s/:\n", outDir)
+		carFilenames := make([]string, len(bb.boxes))
 		for i, box := range bb.boxes {
-			out := new(bytes.Buffer)
-			if err := car.WriteCarWithWalker(context.TODO(), bb.dagService, box.Roots, out, BoxCarWalkFunc(box)); err != nil {
+			boxIdWidth := 1 + int(math.Log10(float64(len(bb.boxes))))
+			carFilename := fmt.Sprintf("box-%s-%*d.car", root.String(), boxIdWidth, i)
+			carFilenames[i] = carFilename
+			carPath := filepath.Join(outDir, carFilename)
+
+			bw := NewBoxWriter(bb.dagService, box, carPath)
+			if err := bw.Write(ctx); err != nil {
 				return xerrors.Errorf("write car failed: %w", err)
 			}
 
-			boxIdWidth := 1 + int(math.Log10(float64(len(bb.boxes))))
-			carFilename := fmt.Sprintf("box-%s-%*d.car", root.String(), boxIdWidth, i)
-			fmt.Fprintf(os.Stderr, "%s\t%s\n", units.BytesSize(float64(out.Len())), carFilename)
-			err = ioutil.WriteFile(filepath.Join(outDir, carFilename), out.Bytes(), 0644)
+			fi, err := os.Stat(carPath)
+			if err != nil {
+				return xerrors.Errorf("stat car file failed: %w", err)
+			}
+			fmt.Fprintf(os.Stderr, "%s\t%s\n", units.BytesSize(float64(fi.Size())), carFilename)
+		}
+
+		if cctx.Bool("manifest") {
+			manifestCid, err := WriteManifest(bb.boxes, carFilenames, outDir)
 			if err != nil {
-				return xerrors.Errorf("write file failed: %w", err)
+				return xerrors.Errorf("writing manifest: %w", err)
 			}
+			fmt.Fprintf(os.Stderr, "\nWrote manifest.json/manifest.cbor, manifest CID: %s\n", manifestCid)
 		}
 
 		return nil
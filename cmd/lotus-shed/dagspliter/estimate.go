@@ -0,0 +1,161 @@
+package dagspliter
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	mdag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	"golang.org/x/xerrors"
+)
+
+// Constants used by the analytical UnixFS file size estimator below. These
+// mirror go-unixfs/importer's balanced-layout defaults; a DAG built with
+// different chunker/fanout settings will only be approximated, not matched
+// exactly.
+const (
+	defaultChunkSize = 256 * 1024
+	defaultFanout    = 174
+
+	// Rough per-link overhead: a CIDv1 sha2-256 is 36 bytes, plus a few
+	// bytes of protobuf/varint framing for the link itself.
+	estimatedLinkOverhead = 36 + 4
+	// Rough per-block framing overhead in the resulting CAR (varint length
+	// prefix + CID).
+	estimatedBlockOverhead = 40
+)
+
+// BoxPlan is the dry-run counterpart of Box: what EstimateBoxes predicts a
+// Box will look like once actually packed, without necessarily having
+// fetched every block that will end up in it.
+type BoxPlan struct {
+	Index int
+	// Roots/External are only populated when we had to actually fetch the
+	// DAG to plan it (see EstimateBoxes); for the fast analytical path over
+	// plain UnixFS files they're left nil since we never saw the
+	// intermediate CIDs.
+	Roots    []cid.Cid
+	External []cid.Cid
+
+	EstimatedBytes uint64
+}
+
+// EstimateBoxes predicts how many boxes a DAG rooted at root will be split
+// into, and their approximate sizes, without walking and fetching every
+// block. For plain UnixFS files this is done analytically from the file's
+// declared size using the default chunker/fanout parameters. Anything else
+// (directories, HAMT shards, symlinks, metadata nodes) doesn't have a size
+// that's a predictable function of its DAG shape, so we fall back to
+// actually building the boxes with the regular builder and report their
+// real sizes.
+func EstimateBoxes(ctx context.Context, dagService ipld.DAGService, root cid.Cid, boxMaxSize uint64) ([]*BoxPlan, error) {
+	node, err := dagService.Get(ctx, root)
+	if err != nil {
+		return nil, xerrors.Errorf("getting root node: %w", err)
+	}
+
+	switch n := node.(type) {
+	case *mdag.RawNode:
+		return planBySize(uint64(len(n.RawData())), boxMaxSize), nil
+
+	case *mdag.ProtoNode:
+		fsNode, err := unixfs.FSNodeFromBytes(n.Data())
+		if err != nil {
+			return nil, xerrors.Errorf("loading unixfs node: %w", err)
+		}
+
+		switch fsNode.Type() {
+		case unixfs.TFile, unixfs.TRaw:
+			return planBySize(estimateUnixFSFileSize(fsNode.FileSize()), boxMaxSize), nil
+		default:
+			return estimateByBuilding(ctx, dagService, root, boxMaxSize)
+		}
+
+	default:
+		return nil, uio.ErrUnkownNodeType
+	}
+}
+
+// planBySize turns a single estimated byte count into however many
+// boxMaxSize-capped BoxPlans it would take to hold it, without any
+// knowledge of the actual CIDs involved.
+func planBySize(estimatedSize uint64, boxMaxSize uint64) []*BoxPlan {
+	if estimatedSize == 0 {
+		return []*BoxPlan{{Index: 0, EstimatedBytes: 0}}
+	}
+
+	numBoxes := (estimatedSize + boxMaxSize - 1) / boxMaxSize
+	plans := make([]*BoxPlan, 0, numBoxes)
+	remaining := estimatedSize
+	for i := uint64(0); i < numBoxes; i++ {
+		size := boxMaxSize
+		if remaining < size {
+			size = remaining
+		}
+		plans = append(plans, &BoxPlan{Index: int(i), EstimatedBytes: size})
+		remaining -= size
+	}
+	return plans
+}
+
+// estimateByBuilding falls back to actually fetching and packing the DAG
+// (reusing the regular builder), for DAG shapes whose size isn't a
+// predictable function of a single declared length.
+func estimateByBuilding(ctx context.Context, dagService ipld.DAGService, root cid.Cid, boxMaxSize uint64) ([]*BoxPlan, error) {
+	b := &builder{
+		dagService: dagService,
+		boxMaxSize: boxMaxSize,
+	}
+	b.newBox()
+
+	if err := b.add(ctx, root); err != nil {
+		return nil, xerrors.Errorf("building boxes to estimate sizes: %w", err)
+	}
+
+	sizes := b.sizes()
+	plans := make([]*BoxPlan, len(b.boxes))
+	for i, box := range b.boxes {
+		plans[i] = &BoxPlan{
+			Index:          i,
+			Roots:          box.Roots,
+			External:       box.External,
+			EstimatedBytes: sizes[i],
+		}
+	}
+	return plans, nil
+}
+
+// estimateUnixFSFileSize predicts the total CAR-encoded size of a balanced
+// UnixFS file DAG holding fileSize bytes of data, using the default chunk
+// size and fanout. It follows the recurrence a balanced UnixFS DAG actually
+// has: size(n) = header + sum(childCIDLen + varint + size(child)), with
+// leaves contributing min(remaining, chunkSize) + per-block overhead.
+//
+// Rather than recursing per-node (which would need to know the real tree
+// shape), it computes the same total bottom-up: start from the leaf count,
+// then repeatedly group leaves/nodes into parents of up to defaultFanout
+// children until a single root remains, accumulating the per-child link
+// overhead one level at a time.
+func estimateUnixFSFileSize(fileSize uint64) uint64 {
+	if fileSize <= defaultChunkSize {
+		return fileSize + estimatedBlockOverhead
+	}
+
+	numLeaves := (fileSize + defaultChunkSize - 1) / defaultChunkSize
+	total := fileSize + numLeaves*estimatedBlockOverhead
+
+	count := numLeaves
+	for count > 1 {
+		// `count` children get referenced by however many parents we need
+		// at this level, each child contributing a link (CID + varint) to
+		// its parent regardless of which parent it lands in.
+		total += count * estimatedLinkOverhead
+
+		count = (count + defaultFanout - 1) / defaultFanout
+		total += count * estimatedBlockOverhead // parent node framing
+	}
+
+	return total
+}
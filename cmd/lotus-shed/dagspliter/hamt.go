@@ -0,0 +1,90 @@
+package dagspliter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	mdag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"golang.org/x/xerrors"
+)
+
+// isHAMTShard reports whether node is the root of a unixfs.THAMTShard
+// sub-DAG, i.e. a directory large enough that go-unixfs sharded it into a
+// HAMT instead of a flat list of links.
+func isHAMTShard(node ipld.Node) bool {
+	pbNode, ok := node.(*mdag.ProtoNode)
+	if !ok {
+		return false
+	}
+	fsNode, err := unixfs.FSNodeFromBytes(pbNode.Data())
+	if err != nil {
+		return false
+	}
+	return fsNode.Type() == unixfs.THAMTShard
+}
+
+// packHAMTShard packs a HAMT-sharded directory that's too big to fit in the
+// current box. A shard's raw protobuf links are buckets keyed by hash
+// prefix: some point at further sub-shards continuing the same logical
+// directory, others point directly at real directory entries. Those two
+// kinds need very different treatment:
+//
+//   - Sub-shard nodes are part of the directory's own skeleton, not a
+//     separate unit -- they're accounted into the current box (addSize) and
+//     recursed into, same as this node.
+//   - Real entries are packed as their own unit: added as an External link
+//     on the current box and returned so the caller queues each as the root
+//     of a future box.
+//
+// This keeps the HAMT root (and every internal shard node on the path to
+// it) reachable and written out whenever its own Root is packed, instead of
+// being silently dropped -- which is what using hamt.Shard.EnumLinks did
+// before: it flattens straight through to the final entries, so none of the
+// skeleton's own size was ever accounted for or packed.
+//
+// deferred is true when even this node's own bytes didn't fit in the
+// current (non-empty) box; in that case nodeCid itself is returned as the
+// sole entry and the caller must not treat it as packed into this box.
+func (b *builder) packHAMTShard(ctx context.Context, nodeCid cid.Cid, node ipld.Node) (entries []cid.Cid, deferred bool, err error) {
+	pbNode, ok := node.(*mdag.ProtoNode)
+	if !ok {
+		return nil, false, mdag.ErrNotProtobuf
+	}
+
+	nodeSize := getSingleNodeSize(node)
+	if !b.fits(nodeSize) && !b.emptyBox() {
+		b.addExternalLink(nodeCid)
+		b.print(fmt.Sprintf("hamt shard node %s too big for current box, deferring to another one", nodeCid))
+		return []cid.Cid{nodeCid}, true, nil
+	}
+	b.addSize(nodeSize)
+
+	for _, link := range pbNode.Links() {
+		childNode, err := b.dagService.Get(ctx, link.Cid)
+		if err != nil {
+			return nil, false, xerrors.Errorf("getting hamt child %s: %w", link.Cid, err)
+		}
+
+		if isHAMTShard(childNode) {
+			// Still the same directory's skeleton: recurse rather than
+			// treating it as a separate packable unit.
+			childEntries, _, err := b.packHAMTShard(ctx, link.Cid, childNode)
+			if err != nil {
+				return nil, false, err
+			}
+			entries = append(entries, childEntries...)
+			continue
+		}
+
+		// A real directory entry: its sub-DAG is packed as its own unit.
+		b.addExternalLink(link.Cid)
+		entries = append(entries, link.Cid)
+	}
+
+	b.print(fmt.Sprintf("hamt shard node %s packed, %d entries found below it", nodeCid, len(entries)))
+
+	return entries, false, nil
+}
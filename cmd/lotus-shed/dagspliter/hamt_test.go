@@ -0,0 +1,131 @@
+package dagspliter
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	mdag "github.com/ipfs/go-merkledag"
+	dstest "github.com/ipfs/go-merkledag/test"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/stretchr/testify/require"
+)
+
+// makeShardedDir builds a synthetic UnixFS directory with numEntries small
+// files in it, forcing it into a (possibly multi-level) HAMT shard well
+// before the real go-unixfs default threshold so the test stays fast.
+func makeShardedDir(t *testing.T, ctx context.Context, dagService ipld.DAGService, numEntries int) cid.Cid {
+	t.Helper()
+
+	// go-unixfs switches a directory to HAMT sharding once its estimated
+	// size in bytes reaches this threshold; lowering it here shards the
+	// directory from its first entries on. The shard width stays the
+	// go-unixfs default, so extra levels come from hash-prefix collisions.
+	oldThreshold := uio.HAMTShardingSize
+	uio.HAMTShardingSize = 4
+	defer func() { uio.HAMTShardingSize = oldThreshold }()
+
+	dir := uio.NewDirectory(dagService)
+	for i := 0; i < numEntries; i++ {
+		leaf := mdag.NewRawNode([]byte(fmt.Sprintf("entry-%d", i)))
+		require.NoError(t, dagService.Add(ctx, leaf))
+		require.NoError(t, dir.AddChild(ctx, fmt.Sprintf("entry-%d", i), leaf))
+	}
+
+	node, err := dir.GetNode()
+	require.NoError(t, err)
+	require.NoError(t, dagService.Add(ctx, node))
+
+	return node.Cid()
+}
+
+func TestPackHAMTShard(t *testing.T) {
+	ctx := context.Background()
+	dagService := dstest.Mock()
+
+	const numEntries = 200 // > 174, enough collisions for multi-level shards
+	root := makeShardedDir(t, ctx, dagService, numEntries)
+
+	rootNode, err := dagService.Get(ctx, root)
+	require.NoError(t, err)
+	require.True(t, isHAMTShard(rootNode))
+
+	// Generous box size: the whole skeleton (root + every internal
+	// sub-shard) should comfortably fit, so every level gets recursed into
+	// instead of deferred, and every leaf entry is returned.
+	b := &builder{dagService: dagService, boxMaxSize: 1 << 20}
+	b.newBox()
+
+	newRoots, deferred, err := b.packHAMTShard(ctx, root, rootNode)
+	require.NoError(t, err)
+	require.False(t, deferred)
+	require.Len(t, newRoots, numEntries)
+	require.Len(t, b.box().External, numEntries)
+
+	// The skeleton itself (root plus internal sub-shard nodes) must have
+	// been accounted for, not just silently skipped.
+	require.Greater(t, b.used(), uint64(0))
+}
+
+func TestPackHAMTShardDefersWhenTooBig(t *testing.T) {
+	ctx := context.Background()
+	dagService := dstest.Mock()
+
+	const numEntries = 200
+	root := makeShardedDir(t, ctx, dagService, numEntries)
+
+	rootNode, err := dagService.Get(ctx, root)
+	require.NoError(t, err)
+
+	b := &builder{dagService: dagService, boxMaxSize: 1}
+	b.newBox()
+	b.addSize(1) // box is no longer empty, so even a 1-byte budget can't be overflowed
+
+	newRoots, deferred, err := b.packHAMTShard(ctx, root, rootNode)
+	require.NoError(t, err)
+	require.True(t, deferred)
+	require.Equal(t, []cid.Cid{root}, newRoots)
+	require.Contains(t, b.box().External, root)
+}
+
+func TestAddSplitsShardedDirectoryAcrossBoxes(t *testing.T) {
+	ctx := context.Background()
+	dagService := dstest.Mock()
+
+	const numEntries = 200
+	const boxMaxSize = 256
+	root := makeShardedDir(t, ctx, dagService, numEntries)
+
+	// The HAMT root is the largest single node of the directory.
+	rootNode, err := dagService.Get(ctx, root)
+	require.NoError(t, err)
+
+	b := &builder{dagService: dagService, boxMaxSize: boxMaxSize}
+	b.newBox()
+	require.NoError(t, b.add(ctx, root))
+
+	require.Greater(t, len(b.boxes), 1, "expected the sharded directory to be split across more than one box")
+
+	// The HAMT root itself must be retained as a Root somewhere, not just
+	// its entries externalized -- otherwise the directory node is missing
+	// from every CAR.
+	var foundRoot bool
+	for _, box := range b.boxes {
+		for _, r := range box.Roots {
+			if r == root {
+				foundRoot = true
+			}
+		}
+	}
+	require.True(t, foundRoot, "expected the hamt shard root to be packed as a Root in some box")
+
+	// No box should have silently absorbed a skeleton far beyond its
+	// budget: only the single-node "doesn't fit in any box" overflow case
+	// (bounded by one node's own raw size) is allowed.
+	for i, size := range b.sizes() {
+		require.LessOrEqual(t, size, uint64(boxMaxSize)+uint64(len(rootNode.RawData())),
+			"box %d grew far beyond boxMaxSize, shard skeleton accounting is unbounded", i)
+	}
+}
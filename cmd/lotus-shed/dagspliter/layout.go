@@ -0,0 +1,132 @@
+package dagspliter
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	mdag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"golang.org/x/xerrors"
+)
+
+// Layout picks how a builder interprets and packs the shape of a DAG.
+type Layout int
+
+const (
+	// LayoutBalanced is the default: no assumptions about DAG shape beyond
+	// what getTreeSize/add already do.
+	LayoutBalanced Layout = iota
+	// LayoutTrickle recognizes trickle-DAG layered structure (as produced
+	// by go-unixfs's trickle importer) and prefers packing whole layers
+	// together, so a client reading a prefix of the file via a range or
+	// entity selector gets boxes aligned to that access pattern.
+	LayoutTrickle
+)
+
+// ParseLayout parses the --layout flag value.
+func ParseLayout(s string) (Layout, error) {
+	switch s {
+	case "", "balanced":
+		return LayoutBalanced, nil
+	case "trickle":
+		return LayoutTrickle, nil
+	default:
+		return 0, xerrors.Errorf("unknown layout %q, expected \"balanced\" or \"trickle\"", s)
+	}
+}
+
+// isTrickleLayout reports whether node looks like the root of a trickle-DAG
+// layer: a trickle node holds some leaves directly, followed by groups of
+// children of growing depth, so its last child is among the deepest --
+// layers grow as go-unixfs's trickle importer builds them. Via one level of
+// child-depth analysis this accepts a node whose children are never deeper
+// than its last child and whose first child is strictly shallower than it,
+// akin to the shape `verifyTDagRec` checks in go-unixfs's own trickle tests.
+// A balanced DAG's children are all the same depth, so this rejects it.
+func isTrickleLayout(ctx context.Context, dagService ipld.DAGService, node ipld.Node) (bool, error) {
+	pbNode, ok := node.(*mdag.ProtoNode)
+	if !ok {
+		return false, nil
+	}
+	fsNode, err := unixfs.FSNodeFromBytes(pbNode.Data())
+	if err != nil || fsNode.Type() != unixfs.TFile {
+		return false, nil
+	}
+
+	links := node.Links()
+	if len(links) < 2 {
+		// A lone leaf or balanced-looking fanout isn't a layered structure
+		// we can usefully split on; trickle layers need at least one leaf
+		// plus a continuation link.
+		return false, nil
+	}
+
+	continuationNode, err := dagService.Get(ctx, links[len(links)-1].Cid)
+	if err != nil {
+		return false, xerrors.Errorf("getting trickle continuation %s: %w", links[len(links)-1].Cid, err)
+	}
+	continuationDepth, err := trickleDepth(ctx, dagService, continuationNode)
+	if err != nil {
+		return false, err
+	}
+
+	for i, link := range links[:len(links)-1] {
+		leafNode, err := dagService.Get(ctx, link.Cid)
+		if err != nil {
+			return false, xerrors.Errorf("getting trickle leaf %s: %w", link.Cid, err)
+		}
+		leafDepth, err := trickleDepth(ctx, dagService, leafNode)
+		if err != nil {
+			return false, err
+		}
+		if leafDepth > continuationDepth || (i == 0 && leafDepth == continuationDepth) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// trickleDepth returns how many layers are nested under node: 0 for a raw
+// leaf or a node with no links, otherwise 1 + the depth of its last child --
+// the continuation, by trickle's own construction.
+func trickleDepth(ctx context.Context, dagService ipld.DAGService, node ipld.Node) (int, error) {
+	links := node.Links()
+	if len(links) == 0 {
+		return 0, nil
+	}
+
+	last, err := dagService.Get(ctx, links[len(links)-1].Cid)
+	if err != nil {
+		return 0, xerrors.Errorf("getting node %s: %w", links[len(links)-1].Cid, err)
+	}
+	depth, err := trickleDepth(ctx, dagService, last)
+	if err != nil {
+		return 0, err
+	}
+	return depth + 1, nil
+}
+
+// packTrickleLayer splits a trickle-layout node into the part that belongs
+// to its own layer (the node itself and all but its last child) and the
+// continuation into the next layer (its last child), returning the
+// continuation's CID and the estimated size of everything but it.
+func (b *builder) packTrickleLayer(ctx context.Context, node ipld.Node, treeSize uint64) (cid.Cid, uint64, error) {
+	links := node.Links()
+	continuation := links[len(links)-1]
+
+	contNode, err := b.dagService.Get(ctx, continuation.Cid)
+	if err != nil {
+		return cid.Undef, 0, xerrors.Errorf("getting trickle continuation %s: %w", continuation.Cid, err)
+	}
+	contSize, err := b.getTreeSize(contNode)
+	if err != nil {
+		return cid.Undef, 0, xerrors.Errorf("getting trickle continuation tree size: %w", err)
+	}
+	if contSize > treeSize {
+		return cid.Undef, 0, xerrors.Errorf("continuation %s reports larger size than its own parent tree", continuation.Cid)
+	}
+
+	return continuation.Cid, treeSize - contSize, nil
+}
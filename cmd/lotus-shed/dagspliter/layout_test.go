@@ -0,0 +1,77 @@
+package dagspliter
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	ipld "github.com/ipfs/go-ipld-format"
+	dstest "github.com/ipfs/go-merkledag/test"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	uih "github.com/ipfs/go-unixfs/importer/helpers"
+	"github.com/ipfs/go-unixfs/importer/trickle"
+	"github.com/stretchr/testify/require"
+)
+
+// buildFile imports data into dagService using the given unixfs layout
+// (balanced.Layout or trickle.Layout), with small chunk/link sizes so a
+// modest amount of data still spans several layers/levels.
+func buildFile(t *testing.T, ctx context.Context, dagService ipld.DAGService, data []byte, chunkSize int64, maxLinks int, layout func(*uih.DagBuilderHelper) (ipld.Node, error)) ipld.Node {
+	t.Helper()
+
+	spl := chunker.NewSizeSplitter(bytes.NewReader(data), chunkSize)
+	params := uih.DagBuilderParams{
+		Dagserv:  dagService,
+		Maxlinks: maxLinks,
+	}
+	db, err := params.New(spl)
+	require.NoError(t, err)
+
+	node, err := layout(db)
+	require.NoError(t, err)
+	return node
+}
+
+func TestIsTrickleLayoutDetectsTrickleDAG(t *testing.T) {
+	ctx := context.Background()
+	dagService := dstest.Mock()
+
+	data := bytes.Repeat([]byte{0xAA}, 64*1024)
+	root := buildFile(t, ctx, dagService, data, 256, 4, trickle.Layout)
+
+	isTrickle, err := isTrickleLayout(ctx, dagService, root)
+	require.NoError(t, err)
+	require.True(t, isTrickle, "expected a trickle-imported file to be recognized as trickle-layout")
+}
+
+func TestIsTrickleLayoutRejectsBalancedDAG(t *testing.T) {
+	ctx := context.Background()
+	dagService := dstest.Mock()
+
+	data := bytes.Repeat([]byte{0xAA}, 64*1024)
+	root := buildFile(t, ctx, dagService, data, 256, 4, balanced.Layout)
+
+	isTrickle, err := isTrickleLayout(ctx, dagService, root)
+	require.NoError(t, err)
+	require.False(t, isTrickle, "a balanced DAG's children are all roughly the same depth and shouldn't be mistaken for a trickle layer")
+}
+
+func TestAddKeepsTrickleLayerTogether(t *testing.T) {
+	ctx := context.Background()
+	dagService := dstest.Mock()
+
+	data := bytes.Repeat([]byte{0xAA}, 64*1024)
+	root := buildFile(t, ctx, dagService, data, 256, 4, trickle.Layout)
+
+	b := &builder{dagService: dagService, boxMaxSize: 4096, layout: LayoutTrickle}
+	b.newBox()
+
+	require.NoError(t, b.add(ctx, root.Cid()))
+
+	require.NotEmpty(t, b.boxes)
+	for i, size := range b.sizes() {
+		require.LessOrEqual(t, size, uint64(4096*2),
+			"box %d grew far beyond boxMaxSize packing trickle layers", i)
+	}
+}
@@ -0,0 +1,127 @@
+package dagspliter
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// ManifestEntry describes one packed Box: its CAR filename, the CAR file's
+// own content-addressed CID, its DAG roots and external CIDs, byte size,
+// and a Merkle link to the previous box's entry.
+type ManifestEntry struct {
+	Index       int       `json:"index"`
+	CarFilename string    `json:"carFilename"`
+	CarCID      cid.Cid   `json:"carCid"`
+	Roots       []cid.Cid `json:"roots"`
+	External    []cid.Cid `json:"external"`
+	Size        uint64    `json:"size"`
+	// Previous links to the CID of the previous box's ManifestEntry (as
+	// encoded in manifest.cbor), chaining the whole manifest into a single
+	// content-addressed, tamper-evident structure. Nil for box 0.
+	//
+	// This must stay a pointer: go-ipld-cbor's cid.Cid atlas entry rejects
+	// cid.Undef outright (there's no such thing as a link to "nothing"), so
+	// box 0 -- which has no previous entry -- needs a field that can be
+	// absent rather than a defined-but-empty CID. A nil *cid.Cid encodes as
+	// plain CBOR null; a non-nil one still dereferences through the same
+	// atlas entry as a bare cid.Cid, so it round-trips as a real tag-42 link.
+	Previous *cid.Cid `json:"previous,omitempty"`
+}
+
+// WriteManifest writes manifest.json and manifest.cbor into dir, one entry
+// per box in boxes (matched positionally with carFilenames, the CAR file
+// each box was written to). Each entry links to the CID of the previous
+// entry, so a downstream tool can walk the chain to confirm a full set of
+// boxes reconstitutes the original root without re-walking the DAG, and so
+// box generation can be resumed or parallelized keyed on the manifest. It
+// returns the CID of manifest.cbor for the caller to print/record.
+func WriteManifest(boxes []*Box, carFilenames []string, dir string) (cid.Cid, error) {
+	if len(boxes) != len(carFilenames) {
+		return cid.Undef, xerrors.Errorf("boxes/carFilenames length mismatch: %d != %d", len(boxes), len(carFilenames))
+	}
+
+	entries := make([]*ManifestEntry, 0, len(boxes))
+	var previous *cid.Cid
+	for i, box := range boxes {
+		carPath := filepath.Join(dir, carFilenames[i])
+
+		fi, err := os.Stat(carPath)
+		if err != nil {
+			return cid.Undef, xerrors.Errorf("stat car file %s: %w", carPath, err)
+		}
+
+		carCid, err := hashFile(carPath)
+		if err != nil {
+			return cid.Undef, xerrors.Errorf("hashing car file %s: %w", carPath, err)
+		}
+
+		entry := &ManifestEntry{
+			Index:       i,
+			CarFilename: carFilenames[i],
+			CarCID:      carCid,
+			Roots:       box.Roots,
+			External:    box.External,
+			Size:        uint64(fi.Size()),
+			Previous:    previous,
+		}
+		entries = append(entries, entry)
+
+		node, err := cbornode.WrapObject(entry, mh.SHA2_256, -1)
+		if err != nil {
+			return cid.Undef, xerrors.Errorf("encoding manifest entry %d: %w", i, err)
+		}
+		entryCid := node.Cid()
+		previous = &entryCid
+	}
+
+	jsonBytes, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("marshaling manifest json: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), jsonBytes, 0644); err != nil {
+		return cid.Undef, xerrors.Errorf("writing manifest.json: %w", err)
+	}
+
+	manifestNode, err := cbornode.WrapObject(entries, mh.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("encoding manifest.cbor: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "manifest.cbor"), manifestNode.RawData(), 0644); err != nil {
+		return cid.Undef, xerrors.Errorf("writing manifest.cbor: %w", err)
+	}
+
+	return manifestNode.Cid(), nil
+}
+
+// hashFile computes a raw-codec CIDv1 sha2-256 hash over a file's contents.
+// This is what identifies a box's CARv2 output in the manifest without
+// needing to re-derive a CAR-specific digest from the box's DAG roots.
+func hashFile(path string) (cid.Cid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer f.Close()
+
+	hasher, err := mh.GetHasher(mh.SHA2_256)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if _, err := io.Copy(hasher, f); err != nil {
+		return cid.Undef, err
+	}
+
+	digest, err := mh.Encode(hasher.Sum(nil), mh.SHA2_256)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return cid.NewCidV1(cid.Raw, digest), nil
+}
@@ -0,0 +1,46 @@
+package dagspliter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteManifestChainsPreviousLinks(t *testing.T) {
+	dir := t.TempDir()
+
+	const numBoxes = 3
+	boxes := make([]*Box, numBoxes)
+	carFilenames := make([]string, numBoxes)
+	for i := 0; i < numBoxes; i++ {
+		carFilenames[i] = fmt.Sprintf("box-%d.car", i)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, carFilenames[i]), []byte(fmt.Sprintf("fake car %d", i)), 0644))
+		boxes[i] = &Box{Roots: []cid.Cid{}, External: []cid.Cid{}}
+	}
+
+	_, err := WriteManifest(boxes, carFilenames, dir)
+	require.NoError(t, err)
+
+	raw, err := os.ReadFile(filepath.Join(dir, "manifest.cbor"))
+	require.NoError(t, err)
+
+	var decoded []*ManifestEntry
+	require.NoError(t, cbornode.DecodeInto(raw, &decoded))
+	require.Len(t, decoded, numBoxes)
+
+	require.Nil(t, decoded[0].Previous, "the first entry has no previous box")
+
+	for i := 1; i < numBoxes; i++ {
+		prevNode, err := cbornode.WrapObject(decoded[i-1], mh.SHA2_256, -1)
+		require.NoError(t, err)
+		require.NotNil(t, decoded[i].Previous)
+		require.Equal(t, prevNode.Cid(), *decoded[i].Previous,
+			"entry %d's Previous should link to entry %d's own CBOR-encoded CID", i, i-1)
+	}
+}
@@ -0,0 +1,129 @@
+package dagspliter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	unixfsnode "github.com/ipfs/go-unixfsnode"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	ipldprime "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"golang.org/x/xerrors"
+)
+
+// ParseSelector decodes a dag-json encoded IPLD selector, as produced by
+// e.g. `ipfs dag export --selector` or lassie's trustless-gateway selectors,
+// into a selector.Selector ready to hand to addWithSelector.
+//
+// FIXME: Also accept the textual selector DSL (ssb-style), not just raw
+//  dag-json, once we pull in a parser for it.
+func ParseSelector(raw string) (selector.Selector, error) {
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagjson.Decode(nb, strings.NewReader(raw)); err != nil {
+		return nil, xerrors.Errorf("decoding selector as dag-json: %w", err)
+	}
+
+	sel, err := selector.ParseSelector(nb.Build())
+	if err != nil {
+		return nil, xerrors.Errorf("parsing selector node: %w", err)
+	}
+	return sel, nil
+}
+
+// addWithSelector is the selector-constrained counterpart of add. Instead of
+// walking the whole DAG under root with mdag.Walk, it walks it with
+// go-ipld-prime using sel to decide which links to descend into. Every link
+// the selector does not descend into becomes part of the box's External
+// set, so the resulting Box.Roots/Box.External pack exactly the sub-DAG a
+// lassie/IPIP-402 client would receive for that selector -- nothing more.
+//
+// Unlike add, a selector-bounded DAG is assumed to fit a single box: the
+// whole point of supplying a selector is to cut the DAG down to what's
+// actually wanted, so we don't attempt to further split it across boxes.
+func (b *builder) addWithSelector(ctx context.Context, root cid.Cid, sel selector.Selector) error {
+	lsys := dagServiceLinkSystem(b.dagService)
+
+	b.packRoot(root)
+
+	rootLink := cidlink.Link{Cid: root}
+	rootNode, err := lsys.Load(ipldprime.LinkContext{Ctx: ctx}, rootLink, dagpb.Type.PBNode)
+	if err != nil {
+		return xerrors.Errorf("loading selector root %s: %w", root, err)
+	}
+
+	// Every CID the traversal actually loads/descends through -- not just
+	// the ones the selector ultimately matched -- is "visited": for a
+	// path/entity/subset selector that walks *through* intermediate
+	// directories to reach a matched target, those intermediates are
+	// visited (and so kept) without themselves being a match.
+	visited := map[cid.Cid]struct{}{root: {}}
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: dagpb.AddSupportToChooser(basicnode.Chooser),
+		},
+	}
+
+	err = progress.WalkAdv(rootNode, sel, func(prog traversal.Progress, nd ipldprime.Node, reason traversal.VisitReason) error {
+		if c, ok := prog.LastBlock.Link.(cidlink.Link); ok {
+			visited[c.Cid] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("walking selector from %s: %w", root, err)
+	}
+
+	// Every link out of a visited node that the traversal didn't itself
+	// visit is a link the selector chose not to descend into: that's the
+	// frontier we exclude from the box's CAR.
+	for c := range visited {
+		node, err := b.dagService.Get(ctx, c)
+		if err != nil {
+			return xerrors.Errorf("getting node %s: %w", c, err)
+		}
+		for _, link := range node.Links() {
+			if _, ok := visited[link.Cid]; !ok {
+				b.addExternalLink(link.Cid)
+			}
+		}
+	}
+
+	return nil
+}
+
+// dagServiceLinkSystem adapts an ipld.DAGService (go-merkledag's interface,
+// used for the rest of this package) into the go-ipld-prime LinkSystem that
+// selector traversal requires, reading block bytes straight out of the
+// DAGService rather than opening a second path to the blockstore.
+//
+// It also wires up UnixFS ADL reification, so a selector walking a sharded
+// HAMT directory or chunked file sees the same logical directory/byte-range
+// view a lassie/IPIP-402 client's path/entity selectors expect, rather than
+// the raw dag-pb node shape.
+func dagServiceLinkSystem(dagService ipld.DAGService) ipldprime.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx linking.LinkContext, lnk ipldprime.Link) (io.Reader, error) {
+		c, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, xerrors.Errorf("unexpected link type: %T", lnk)
+		}
+		node, err := dagService.Get(lctx.Ctx, c.Cid)
+		if err != nil {
+			return nil, xerrors.Errorf("getting node %s: %w", c.Cid, err)
+		}
+		return bytes.NewReader(node.RawData()), nil
+	}
+	unixfsnode.AddUnixFSReificationToLinkSystem(&lsys)
+	return lsys
+}
@@ -0,0 +1,98 @@
+package dagspliter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	dstest "github.com/ipfs/go-merkledag/test"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/stretchr/testify/require"
+)
+
+// entitySelector builds a selector that fully explores the directory entry
+// named field -- matching it and recursively exploring everything below it
+// -- the same "explore one entity all the way down" shape a lassie
+// trustless-gateway entity/path selector produces, while leaving every
+// other directory entry unexplored.
+func entitySelector(field string) selector.Selector {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	return ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert(field, ssb.ExploreRecursive(selector.RecursionLimitNone(),
+			ssb.ExploreUnion(
+				ssb.Matcher(),
+				ssb.ExploreAll(ssb.ExploreRecursiveEdge()),
+			)))
+	}).Selector()
+}
+
+// carBlocks streams box's CAR output into a buffer (the same walk BoxWriter
+// uses) and returns the set of block CIDs it actually contains.
+func carBlocks(t *testing.T, ctx context.Context, dagService ipld.DAGService, box *Box) map[cid.Cid]struct{} {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, car.WriteCarWithWalker(ctx, dagService, box.Roots, &buf, BoxCarWalkFunc(box)))
+
+	reader, err := car.NewCarReader(&buf)
+	require.NoError(t, err)
+
+	blocks := map[cid.Cid]struct{}{}
+	for {
+		blk, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		blocks[blk.Cid()] = struct{}{}
+	}
+	return blocks
+}
+
+// TestAddWithSelectorProducesExactCAR round-trips a directory-entity
+// selector through addWithSelector and BoxCarWalkFunc the way a real
+// lassie/IPIP-402 request would, then checks the resulting CAR contains
+// every block of the matched entry (including its own chunks, reached only
+// via UnixFS ADL reification of the directory) and none of the sibling
+// entry's blocks.
+func TestAddWithSelectorProducesExactCAR(t *testing.T) {
+	ctx := context.Background()
+	dagService := dstest.Mock()
+
+	matched := buildFile(t, ctx, dagService, bytes.Repeat([]byte{0xBB}, 16*1024), 256, 4, balanced.Layout)
+	skipped := buildFile(t, ctx, dagService, bytes.Repeat([]byte{0xCC}, 16*1024), 256, 4, balanced.Layout)
+	require.NotEmpty(t, matched.Links(), "fixture needs a multi-block file so reification actually matters")
+	require.NotEmpty(t, skipped.Links())
+
+	dir := uio.NewDirectory(dagService)
+	require.NoError(t, dir.AddChild(ctx, "matched", matched))
+	require.NoError(t, dir.AddChild(ctx, "skipped", skipped))
+	dirNode, err := dir.GetNode()
+	require.NoError(t, err)
+	require.NoError(t, dagService.Add(ctx, dirNode))
+
+	b := &builder{dagService: dagService}
+	b.newBox()
+	require.NoError(t, b.addWithSelector(ctx, dirNode.Cid(), entitySelector("matched")))
+
+	blocks := carBlocks(t, ctx, dagService, b.box())
+
+	require.Contains(t, blocks, dirNode.Cid())
+	require.Contains(t, blocks, matched.Cid())
+	for _, link := range matched.Links() {
+		require.Contains(t, blocks, link.Cid, "matched entry's own chunks must be in the CAR")
+	}
+
+	require.NotContains(t, blocks, skipped.Cid())
+	for _, link := range skipped.Links() {
+		require.NotContains(t, blocks, link.Cid, "unselected sibling's chunks must not leak into the CAR")
+	}
+}